@@ -1,55 +1,211 @@
 package consul
 
 import (
+	"container/heap"
 	"fmt"
-	"github.com/armon/gomdb"
 	"github.com/hashicorp/consul/consul/structs"
 	"io"
-	"io/ioutil"
 	"log"
-	"os"
-	"runtime"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-radix"
+	"github.com/hashicorp/go-memdb"
 )
 
 const (
-	dbNodes                  = "nodes"
-	dbServices               = "services"
-	dbChecks                 = "checks"
-	dbKVS                    = "kvs"
-	dbSessions               = "sessions"
-	dbSessionChecks          = "sessionChecks"
-	dbMaxMapSize32bit uint64 = 512 * 1024 * 1024       // 512MB maximum size
-	dbMaxMapSize64bit uint64 = 32 * 1024 * 1024 * 1024 // 32GB maximum size
+	dbNodes         = "nodes"
+	dbServices      = "services"
+	dbChecks        = "checks"
+	dbKVS           = "kvs"
+	dbSessions      = "sessions"
+	dbSessionChecks = "sessionChecks"
+
+	// dbIndexes is the bookkeeping table that lastIndexTxn/
+	// setLastIndexTxn use to track the last Raft index that modified
+	// each of the tables above.
+	dbIndexes = "indexes"
 )
 
+// defaultLockDelay is applied to a KV lock released by an expired or
+// destroyed session when the session itself didn't specify one.
+const defaultLockDelay = 15 * time.Second
+
 // The StateStore is responsible for maintaining all the Consul
 // state. It is manipulated by the FSM which maintains consistency
 // through the use of Raft. The goals of the StateStore are to provide
 // high concurrency for read operations without blocking writes, and
 // to provide write availability in the face of reads. The current
-// implementation uses the Lightning Memory-Mapped Database (MDB).
-// This gives us Multi-Version Concurrency Control for "free"
+// implementation is built on top of go-memdb, which gives us
+// lock-free reads against a stable, point-in-time snapshot of the
+// data while writers path-copy only the radix tree nodes they touch.
+// Commit() then atomically publishes the new tree roots, so readers
+// that are already in flight keep seeing a consistent view.
 type StateStore struct {
-	logger            *log.Logger
-	path              string
-	env               *mdb.Env
-	nodeTable         *MDBTable
-	serviceTable      *MDBTable
-	checkTable        *MDBTable
-	kvsTable          *MDBTable
-	sessionTable      *MDBTable
-	sessionCheckTable *MDBTable
-	tables            MDBTables
-	watch             map[*MDBTable]*NotifyGroup
-	queryTables       map[string]MDBTables
-}
-
-// StateSnapshot is used to provide a point-in-time snapshot
-// It works by starting a readonly transaction against all tables.
+	logger *log.Logger
+	db     *memdb.MemDB
+	watch  map[string]*NotifyGroup
+
+	// keyWatches holds a per-table PrefixWatch, used so that a
+	// WatchKey/WatchPrefix subscriber is only woken by commits that
+	// actually mutate a row under its key/prefix, instead of by every
+	// write to the table.
+	keyWatches map[string]*PrefixWatch
+
+	// sessionLock guards the session TTL bookkeeping below. It is
+	// intentionally separate from the MemDB transactions, since the
+	// invalidator needs to read/mutate the expiration heap without
+	// holding open a StateStore transaction.
+	sessionLock    sync.Mutex
+	sessionExpires map[string]*sessionExpiry
+	sessionHeap    sessionExpiryHeap
+	sessionWakeCh  chan struct{}
+	sessionStopCh  chan struct{}
+
+	// lockDelay tracks, per KV key, the time before which a new
+	// KVSLock acquire must be rejected. It is populated whenever a
+	// session holding a lock is destroyed and is intentionally kept
+	// out of MemDB: it is ephemeral, single-node, best-effort state,
+	// not replicated data.
+	lockDelayLock sync.Mutex
+	lockDelay     map[string]time.Time
+}
+
+// sessionExpiry is the expiration heap entry for a single session,
+// keyed by its absolute TTL deadline so the invalidator can sleep
+// until the next one is due instead of polling sessionTable.
+type sessionExpiry struct {
+	session  string
+	deadline time.Time
+	index    int
+}
+
+// sessionExpiryHeap is a container/heap min-heap of sessionExpiry,
+// ordered by deadline.
+type sessionExpiryHeap []*sessionExpiry
+
+func (h sessionExpiryHeap) Len() int           { return len(h) }
+func (h sessionExpiryHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h sessionExpiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *sessionExpiryHeap) Push(x interface{}) {
+	item := x.(*sessionExpiry)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *sessionExpiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
+
+// PrefixWatch provides a set of NotifyGroups arranged by key prefix,
+// so that mutating a single row can wake only the watchers whose
+// key or prefix overlaps it instead of the whole table's watchers.
+// It is the fine-grained counterpart to the table-wide NotifyGroups
+// in StateStore.watch.
+//
+// Each key/prefix node is reference-counted: GetSubwatch takes a
+// reference and Release drops one, pruning the radix node once no
+// subscriber remains. This is not handled automatically by any
+// caller-side mechanism - every GetSubwatch (including the ones
+// behind WatchKey/WatchPrefix) must be paired with a Release once the
+// watch is no longer needed, or the node (and its NotifyGroup) is
+// never removed and a long-running leader accumulates one per
+// distinct key/prefix ever watched.
+type PrefixWatch struct {
+	lock sync.Mutex
+	tree *radix.Tree
+}
+
+// refWatch pairs a NotifyGroup with a count of the subscribers
+// currently holding a reference to it, so PrefixWatch knows when its
+// radix node is safe to prune.
+type refWatch struct {
+	group *NotifyGroup
+	refs  int
+}
+
+// NewPrefixWatch creates a new PrefixWatch
+func NewPrefixWatch() *PrefixWatch {
+	return &PrefixWatch{tree: radix.New()}
+}
+
+// GetSubwatch returns the NotifyGroup registered at an exact
+// key/prefix, creating it if this is the first subscriber there, and
+// takes a reference on it. Callers must call Release(prefix) exactly
+// once they stop watching.
+func (p *PrefixWatch) GetSubwatch(prefix string) *NotifyGroup {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if raw, ok := p.tree.Get(prefix); ok {
+		rw := raw.(*refWatch)
+		rw.refs++
+		return rw.group
+	}
+	rw := &refWatch{group: &NotifyGroup{}, refs: 1}
+	p.tree.Insert(prefix, rw)
+	return rw.group
+}
+
+// Release drops a reference taken by a prior GetSubwatch(prefix),
+// deleting the radix node once no subscriber remains.
+func (p *PrefixWatch) Release(prefix string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	raw, ok := p.tree.Get(prefix)
+	if !ok {
+		return
+	}
+	rw := raw.(*refWatch)
+	rw.refs--
+	if rw.refs <= 0 {
+		p.tree.Delete(prefix)
+	}
+}
+
+// Notify wakes every NotifyGroup registered along the path to key
+// (so a watcher on an ancestor prefix still fires), and, when
+// subtree is true, every NotifyGroup registered at or below key (so
+// a watcher on a deleted subtree still fires for each of its
+// descendants).
+func (p *PrefixWatch) Notify(key string, subtree bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.tree.WalkPath(key, func(s string, v interface{}) bool {
+		v.(*refWatch).group.Notify()
+		return false
+	})
+
+	if subtree {
+		p.tree.WalkPrefix(key, func(s string, v interface{}) bool {
+			v.(*refWatch).group.Notify()
+			return false
+		})
+	}
+}
+
+// StateSnapshot is used to provide a point-in-time snapshot. It works
+// by retaining the frozen radix tree roots backing a single read
+// transaction; because the trees are immutable and path-copied on
+// write, the snapshot remains stable regardless of concurrent
+// mutations to the live StateStore.
 type StateSnapshot struct {
 	store     *StateStore
-	tx        *MDBTxn
+	tx        *memdb.Txn
 	lastIndex uint64
 }
 
@@ -70,312 +226,334 @@ func (s *StateSnapshot) Close() error {
 
 // NewStateStore is used to create a new state store
 func NewStateStore(logOutput io.Writer) (*StateStore, error) {
-	// Create a new temp dir
-	path, err := ioutil.TempDir("", "consul")
+	db, err := memdb.NewMemDB(stateStoreSchema())
 	if err != nil {
-		return nil, err
-	}
-
-	// Open the env
-	env, err := mdb.NewEnv()
-	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Failed to create state store: %v", err)
 	}
 
 	s := &StateStore{
 		logger: log.New(logOutput, "", log.LstdFlags),
-		path:   path,
-		env:    env,
-		watch:  make(map[*MDBTable]*NotifyGroup),
+		db:     db,
+		watch:  make(map[string]*NotifyGroup),
 	}
 
-	// Ensure we can initialize
-	if err := s.initialize(); err != nil {
-		env.Close()
-		os.RemoveAll(path)
-		return nil, err
+	s.keyWatches = make(map[string]*PrefixWatch)
+	for _, table := range []string{dbNodes, dbServices, dbChecks, dbKVS, dbSessions, dbSessionChecks} {
+		s.watch[table] = &NotifyGroup{}
+		s.keyWatches[table] = NewPrefixWatch()
 	}
+
+	s.sessionExpires = make(map[string]*sessionExpiry)
+	s.sessionWakeCh = make(chan struct{}, 1)
+	s.lockDelay = make(map[string]time.Time)
 	return s, nil
 }
 
-// Close is used to safely shutdown the state store
+// Close is used to safely shutdown the state store. Since the MemDB
+// backing store lives entirely in-process memory, there is no
+// mmap/tempdir teardown to perform; dropping the reference is enough
+// to let the GC reclaim it.
 func (s *StateStore) Close() error {
-	s.env.Close()
-	os.RemoveAll(s.path)
 	return nil
 }
 
-// initialize is used to setup the store for use
-func (s *StateStore) initialize() error {
-	// Setup the Env first
-	if err := s.env.SetMaxDBs(mdb.DBI(32)); err != nil {
-		return err
-	}
-
-	// Set the maximum db size based on 32/64bit. Since we are
-	// doing an mmap underneath, we need to limit our use of virtual
-	// address space on 32bit, but don't have to care on 64bit.
-	dbSize := dbMaxMapSize32bit
-	if runtime.GOARCH == "amd64" {
-		dbSize = dbMaxMapSize64bit
-	}
-
-	// Increase the maximum map size
-	if err := s.env.SetMapSize(dbSize); err != nil {
-		return err
-	}
-
-	// Optimize our flags for speed over safety, since the Raft log + snapshots
-	// are durable. We treat this as an ephemeral in-memory DB, since we nuke
-	// the data anyways.
-	var flags uint = mdb.NOMETASYNC | mdb.NOSYNC | mdb.NOTLS
-	if err := s.env.Open(s.path, flags, 0755); err != nil {
-		return err
-	}
-
-	// Tables use a generic struct encoder
-	encoder := func(obj interface{}) []byte {
-		buf, err := structs.Encode(255, obj)
-		if err != nil {
-			panic(err)
-		}
-		return buf[1:]
-	}
-
-	// Setup our tables
-	s.nodeTable = &MDBTable{
-		Name: dbNodes,
-		Indexes: map[string]*MDBIndex{
-			"id": &MDBIndex{
-				Unique: true,
-				Fields: []string{"Node"},
+// stateStoreSchema returns the memdb schema used to construct the
+// tables and indexes backing the StateStore. Each table is an
+// independent persistent radix tree; transactions snapshot the
+// current set of roots and path-copy only the nodes they mutate.
+func stateStoreSchema() *memdb.DBSchema {
+	return &memdb.DBSchema{
+		Tables: map[string]*memdb.TableSchema{
+			dbNodes: {
+				Name: dbNodes,
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Node"},
+					},
+				},
 			},
-		},
-		Decoder: func(buf []byte) interface{} {
-			out := new(structs.Node)
-			if err := structs.Decode(buf, out); err != nil {
-				panic(err)
-			}
-			return out
-		},
-	}
-
-	s.serviceTable = &MDBTable{
-		Name: dbServices,
-		Indexes: map[string]*MDBIndex{
-			"id": &MDBIndex{
-				Unique: true,
-				Fields: []string{"Node", "ServiceID"},
+			dbServices: {
+				Name: dbServices,
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:   "id",
+						Unique: true,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&memdb.StringFieldIndex{Field: "Node"},
+								&memdb.StringFieldIndex{Field: "ServiceID"},
+							},
+						},
+					},
+					"service": {
+						Name:         "service",
+						AllowMissing: true,
+						Indexer:      &memdb.StringFieldIndex{Field: "ServiceName"},
+					},
+					"node": {
+						Name:    "node",
+						Indexer: &memdb.StringFieldIndex{Field: "Node"},
+					},
+				},
 			},
-			"service": &MDBIndex{
-				AllowBlank: true,
-				Fields:     []string{"ServiceName"},
+			dbChecks: {
+				Name: dbChecks,
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:   "id",
+						Unique: true,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&memdb.StringFieldIndex{Field: "Node"},
+								&memdb.StringFieldIndex{Field: "CheckID"},
+							},
+						},
+					},
+					"status": {
+						Name:    "status",
+						Indexer: &memdb.StringFieldIndex{Field: "Status"},
+					},
+					"service": {
+						Name:         "service",
+						AllowMissing: true,
+						Indexer:      &memdb.StringFieldIndex{Field: "ServiceName"},
+					},
+					"node": {
+						Name:    "node",
+						Indexer: &memdb.StringFieldIndex{Field: "Node"},
+					},
+					"node_service": {
+						Name:         "node_service",
+						AllowMissing: true,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&memdb.StringFieldIndex{Field: "Node"},
+								&memdb.StringFieldIndex{Field: "ServiceID"},
+							},
+						},
+					},
+				},
 			},
-		},
-		Decoder: func(buf []byte) interface{} {
-			out := new(structs.ServiceNode)
-			if err := structs.Decode(buf, out); err != nil {
-				panic(err)
-			}
-			return out
-		},
-	}
-
-	s.checkTable = &MDBTable{
-		Name: dbChecks,
-		Indexes: map[string]*MDBIndex{
-			"id": &MDBIndex{
-				Unique: true,
-				Fields: []string{"Node", "CheckID"},
+			dbKVS: {
+				Name: dbKVS,
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Key"},
+					},
+					"session": {
+						Name:         "session",
+						AllowMissing: true,
+						Indexer:      &memdb.StringFieldIndex{Field: "Session"},
+					},
+				},
 			},
-			"status": &MDBIndex{
-				Fields: []string{"Status"},
+			dbSessions: {
+				Name: dbSessions,
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "ID"},
+					},
+					"node": {
+						Name:         "node",
+						AllowMissing: true,
+						Indexer:      &memdb.StringFieldIndex{Field: "Node"},
+					},
+				},
 			},
-			"service": &MDBIndex{
-				AllowBlank: true,
-				Fields:     []string{"ServiceName"},
+			dbSessionChecks: {
+				Name: dbSessionChecks,
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:   "id",
+						Unique: true,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&memdb.StringFieldIndex{Field: "Node"},
+								&memdb.StringFieldIndex{Field: "CheckID"},
+								&memdb.StringFieldIndex{Field: "Session"},
+							},
+						},
+					},
+					"session": {
+						Name:         "session",
+						AllowMissing: true,
+						Indexer:      &memdb.StringFieldIndex{Field: "Session"},
+					},
+				},
 			},
-			"node": &MDBIndex{
-				AllowBlank: true,
-				Fields:     []string{"Node", "ServiceID"},
+			dbIndexes: {
+				Name: dbIndexes,
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Key"},
+					},
+				},
 			},
 		},
-		Decoder: func(buf []byte) interface{} {
-			out := new(structs.HealthCheck)
-			if err := structs.Decode(buf, out); err != nil {
-				panic(err)
-			}
-			return out
-		},
 	}
+}
 
-	s.kvsTable = &MDBTable{
-		Name: dbKVS,
-		Indexes: map[string]*MDBIndex{
-			"id": &MDBIndex{
-				Unique: true,
-				Fields: []string{"Key"},
-			},
-			"id_prefix": &MDBIndex{
-				Virtual:   true,
-				RealIndex: "id",
-				Fields:    []string{"Key"},
-				IdxFunc:   DefaultIndexPrefixFunc,
-			},
-		},
-		Decoder: func(buf []byte) interface{} {
-			out := new(structs.DirEntry)
-			if err := structs.Decode(buf, out); err != nil {
-				panic(err)
-			}
-			return out
-		},
+// Watch is used to subscribe a channel to every table a query result
+// depends on. Callers build the same Query they'll read with (e.g.
+// nodeServicesQuery(node)) and pass its Tables() here, so the watch
+// scope can never fall out of sync with what the read actually
+// touches the way a hand-maintained name->tables map could.
+func (s *StateStore) Watch(tables []string, notify chan struct{}) {
+	for _, table := range tables {
+		s.watch[table].Wait(notify)
 	}
+}
 
-	s.sessionTable = &MDBTable{
-		Name: dbSessions,
-		Indexes: map[string]*MDBIndex{
-			"id": &MDBIndex{
-				Unique: true,
-				Fields: []string{"ID"},
-			},
-			"node": &MDBIndex{
-				AllowBlank: true,
-				Fields:     []string{"Node"},
-			},
-		},
-		Decoder: func(buf []byte) interface{} {
-			out := new(structs.Session)
-			if err := structs.Decode(buf, out); err != nil {
-				panic(err)
-			}
-			return out
-		},
-	}
+// WatchKey subscribes notify to mutations of one row's key in the
+// given table, e.g. WatchKey(dbKVS, "foo", ch) wakes on writes/deletes
+// to the "foo" key, not on unrelated keys elsewhere in the KV tree.
+// It is registered the same way as WatchPrefix(table, key), and
+// notifyMutations notifies each mutated key's subtree, so it also
+// wakes on writes to any key that starts with key (e.g. "foobar" or
+// "foo/bar") and to any key that key starts with (e.g. "f").
+// The caller must call UnwatchKey with the same
+// table/key once notify is no longer needed, or the underlying
+// PrefixWatch node for that key is never pruned.
+func (s *StateStore) WatchKey(table, key string, notify chan struct{}) {
+	s.keyWatches[table].GetSubwatch(key).Wait(notify)
+}
 
-	s.sessionCheckTable = &MDBTable{
-		Name: dbSessionChecks,
-		Indexes: map[string]*MDBIndex{
-			"id": &MDBIndex{
-				Unique: true,
-				Fields: []string{"Node", "CheckID", "Session"},
-			},
-		},
-		Decoder: func(buf []byte) interface{} {
-			out := new(sessionCheck)
-			if err := structs.Decode(buf, out); err != nil {
-				panic(err)
-			}
-			return out
-		},
-	}
+// UnwatchKey releases a subscription registered by WatchKey.
+func (s *StateStore) UnwatchKey(table, key string) {
+	s.keyWatches[table].Release(key)
+}
 
-	// Store the set of tables
-	s.tables = []*MDBTable{s.nodeTable, s.serviceTable, s.checkTable,
-		s.kvsTable, s.sessionTable, s.sessionCheckTable}
-	for _, table := range s.tables {
-		table.Env = s.env
-		table.Encoder = encoder
-		if err := table.Init(); err != nil {
-			return err
-		}
+// WatchPrefix subscribes notify to mutations of any row whose key
+// falls under prefix in the given table. The caller must call
+// UnwatchPrefix with the same table/prefix once notify is no longer
+// needed, or the underlying PrefixWatch node for that prefix is never
+// pruned.
+func (s *StateStore) WatchPrefix(table, prefix string, notify chan struct{}) {
+	s.keyWatches[table].GetSubwatch(prefix).Wait(notify)
+}
 
-		// Setup a notification group per table
-		s.watch[table] = &NotifyGroup{}
-	}
+// UnwatchPrefix releases a subscription registered by WatchPrefix.
+func (s *StateStore) UnwatchPrefix(table, prefix string) {
+	s.keyWatches[table].Release(prefix)
+}
 
-	// Setup the query tables
-	s.queryTables = map[string]MDBTables{
-		"Nodes":             MDBTables{s.nodeTable},
-		"Services":          MDBTables{s.serviceTable},
-		"ServiceNodes":      MDBTables{s.nodeTable, s.serviceTable},
-		"NodeServices":      MDBTables{s.nodeTable, s.serviceTable},
-		"ChecksInState":     MDBTables{s.checkTable},
-		"NodeChecks":        MDBTables{s.checkTable},
-		"ServiceChecks":     MDBTables{s.checkTable},
-		"CheckServiceNodes": MDBTables{s.nodeTable, s.serviceTable, s.checkTable},
-		"NodeInfo":          MDBTables{s.nodeTable, s.serviceTable, s.checkTable},
-		"NodeDump":          MDBTables{s.nodeTable, s.serviceTable, s.checkTable},
-		"KVSGet":            MDBTables{s.kvsTable},
-		"KVSList":           MDBTables{s.kvsTable},
-		"KVSListKeys":       MDBTables{s.kvsTable},
+// notifyMutations wakes the table-wide NotifyGroup (for callers that
+// still watch at table granularity) as well as the fine-grained
+// key/prefix watchers for every key actually mutated by the
+// transaction that just committed.
+func (s *StateStore) notifyMutations(table string, keys ...string) {
+	s.watch[table].Notify()
+	w := s.keyWatches[table]
+	for _, key := range keys {
+		w.Notify(key, true)
 	}
-	return nil
 }
 
-// Watch is used to subscribe a channel to a set of MDBTables
-func (s *StateStore) Watch(tables MDBTables, notify chan struct{}) {
-	for _, t := range tables {
-		s.watch[t].Wait(notify)
+// lastIndexTxn returns the max last-index across a set of tables for
+// a given read transaction, mirroring the old MDBTables.LastIndexTxn
+// helper but reading the per-table index out of memdb's "indexes"
+// bookkeeping table.
+func lastIndexTxn(tx *memdb.Txn, tables ...string) uint64 {
+	var max uint64
+	for _, table := range tables {
+		raw, err := tx.First(dbIndexes, "id", table)
+		if err != nil || raw == nil {
+			continue
+		}
+		if idx := raw.(*indexEntry).Value; idx > max {
+			max = idx
+		}
 	}
+	return max
 }
 
-// QueryTables returns the Tables that are queried for a given query
-func (s *StateStore) QueryTables(q string) MDBTables {
-	return s.queryTables[q]
+// indexEntry tracks the last Raft index that modified a given table,
+// stored in memdb alongside the data so it path-copies and snapshots
+// exactly like the rest of the state.
+type indexEntry struct {
+	Key   string
+	Value uint64
+}
+
+// setLastIndexTxn records the last index that modified a table
+func setLastIndexTxn(tx *memdb.Txn, table string, index uint64) error {
+	return tx.Insert(dbIndexes, &indexEntry{Key: table, Value: index})
 }
 
 // EnsureNode is used to ensure a given node exists, with the provided address
 func (s *StateStore) EnsureNode(index uint64, node structs.Node) error {
-	// Start a new txn
-	tx, err := s.nodeTable.StartTxn(false, nil)
-	if err != nil {
-		return err
-	}
+	tx := s.db.Txn(true)
 	defer tx.Abort()
 
-	if err := s.nodeTable.InsertTxn(tx, node); err != nil {
-		return err
+	if err := tx.Insert(dbNodes, &node); err != nil {
+		return fmt.Errorf("failed inserting node: %v", err)
 	}
-	if err := s.nodeTable.SetLastIndexTxn(tx, index); err != nil {
+	if err := setLastIndexTxn(tx, dbNodes, index); err != nil {
 		return err
 	}
-	defer s.watch[s.nodeTable].Notify()
-	return tx.Commit()
+	tx.Commit()
+	s.notifyMutations(dbNodes, node.Node)
+	return nil
 }
 
 // GetNode returns all the address of the known and if it was found
 func (s *StateStore) GetNode(name string) (uint64, bool, string) {
-	idx, res, err := s.nodeTable.Get("id", name)
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	idx := lastIndexTxn(tx, dbNodes)
+	raw, err := tx.First(dbNodes, "id", name)
 	if err != nil {
 		s.logger.Printf("[ERR] consul.state: Error during node lookup: %v", err)
-		return 0, false, ""
+		return idx, false, ""
 	}
-	if len(res) == 0 {
+	if raw == nil {
 		return idx, false, ""
 	}
-	return idx, true, res[0].(*structs.Node).Address
+	return idx, true, raw.(*structs.Node).Address
 }
 
-// GetNodes returns all the known nodes, the slice alternates between
-// the node name and address
+// nodesQuery backs Nodes
+func nodesQuery() *Query { return newQuery(dbNodes, "id") }
+
+// Nodes returns all the known nodes
 func (s *StateStore) Nodes() (uint64, structs.Nodes) {
-	idx, res, err := s.nodeTable.Get("id")
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	q := nodesQuery()
+	idx := lastIndexTxn(tx, q.Tables()...)
+	iter, err := q.Iter(tx)
 	if err != nil {
 		s.logger.Printf("[ERR] consul.state: Error getting nodes: %v", err)
+		return idx, nil
 	}
-	results := make([]structs.Node, len(res))
-	for i, r := range res {
-		results[i] = *r.(*structs.Node)
+	var results structs.Nodes
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		results = append(results, *raw.(*structs.Node))
 	}
 	return idx, results
 }
 
 // EnsureService is used to ensure a given node exposes a service
 func (s *StateStore) EnsureService(index uint64, node string, ns *structs.NodeService) error {
-	tables := MDBTables{s.nodeTable, s.serviceTable}
-	tx, err := tables.StartTxn(false)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
-	}
+	tx := s.db.Txn(true)
 	defer tx.Abort()
 
 	// Ensure the node exists
-	res, err := s.nodeTable.GetTxn(tx, "id", node)
+	raw, err := tx.First(dbNodes, "id", node)
 	if err != nil {
 		return err
 	}
-	if len(res) == 0 {
+	if raw == nil {
 		return fmt.Errorf("Missing node registration")
 	}
 
@@ -388,63 +566,58 @@ func (s *StateStore) EnsureService(index uint64, node string, ns *structs.NodeSe
 		ServicePort: ns.Port,
 	}
 
-	// Ensure the service entry is set
-	if err := s.serviceTable.InsertTxn(tx, &entry); err != nil {
-		return err
+	if err := tx.Insert(dbServices, &entry); err != nil {
+		return fmt.Errorf("failed inserting service: %v", err)
 	}
-	if err := s.serviceTable.SetLastIndexTxn(tx, index); err != nil {
+	if err := setLastIndexTxn(tx, dbServices, index); err != nil {
 		return err
 	}
-	defer s.watch[s.serviceTable].Notify()
-	return tx.Commit()
+	tx.Commit()
+	s.notifyMutations(dbServices, node)
+	return nil
+}
+
+// nodeServicesQuery backs NodeServices
+func nodeServicesQuery(node string) *Query {
+	return newQuery(dbServices, "node", node).Join(dbNodes)
 }
 
 // NodeServices is used to return all the services of a given node
 func (s *StateStore) NodeServices(name string) (uint64, *structs.NodeServices) {
-	tables := s.queryTables["NodeServices"]
-	tx, err := tables.StartTxn(true)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
-	}
+	tx := s.db.Txn(false)
 	defer tx.Abort()
-	return s.parseNodeServices(tables, tx, name)
+	return s.parseNodeServices(tx, name)
 }
 
 // parseNodeServices is used to get the services belonging to a
 // node, using a given txn
-func (s *StateStore) parseNodeServices(tables MDBTables, tx *MDBTxn, name string) (uint64, *structs.NodeServices) {
+func (s *StateStore) parseNodeServices(tx *memdb.Txn, name string) (uint64, *structs.NodeServices) {
 	ns := &structs.NodeServices{
 		Services: make(map[string]*structs.NodeService),
 	}
 
-	// Get the maximum index
-	index, err := tables.LastIndexTxn(tx)
-	if err != nil {
-		panic(fmt.Errorf("Failed to get last index: %v", err))
-	}
+	q := nodeServicesQuery(name)
+	index := lastIndexTxn(tx, q.Tables()...)
 
 	// Get the node first
-	res, err := s.nodeTable.GetTxn(tx, "id", name)
+	raw, err := tx.First(dbNodes, "id", name)
 	if err != nil {
 		s.logger.Printf("[ERR] consul.state: Failed to get node: %v", err)
 	}
-	if len(res) == 0 {
+	if raw == nil {
 		return index, nil
 	}
 
-	// Set the address
-	node := res[0].(*structs.Node)
+	node := raw.(*structs.Node)
 	ns.Node = *node
 
 	// Get the services
-	res, err = s.serviceTable.GetTxn(tx, "id", name)
+	iter, err := q.Iter(tx)
 	if err != nil {
 		s.logger.Printf("[ERR] consul.state: Failed to get node '%s' services: %v", name, err)
 	}
-
-	// Add each service
-	for _, r := range res {
-		service := r.(*structs.ServiceNode)
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		service := raw.(*structs.ServiceNode)
 		srv := &structs.NodeService{
 			ID:      service.ServiceID,
 			Service: service.ServiceName,
@@ -458,83 +631,113 @@ func (s *StateStore) parseNodeServices(tables MDBTables, tx *MDBTxn, name string
 
 // DeleteNodeService is used to delete a node service
 func (s *StateStore) DeleteNodeService(index uint64, node, id string) error {
-	tables := MDBTables{s.serviceTable, s.checkTable}
-	tx, err := tables.StartTxn(false)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
-	}
+	tx := s.db.Txn(true)
 	defer tx.Abort()
 
-	if n, err := s.serviceTable.DeleteTxn(tx, "id", node, id); err != nil {
+	var changedServices, changedChecks bool
+	if n, err := deletePrefixTxn(tx, dbServices, "id", node, id); err != nil {
 		return err
 	} else if n > 0 {
-		if err := s.serviceTable.SetLastIndexTxn(tx, index); err != nil {
+		if err := setLastIndexTxn(tx, dbServices, index); err != nil {
 			return err
 		}
-		defer s.watch[s.serviceTable].Notify()
+		changedServices = true
 	}
-	if n, err := s.checkTable.DeleteTxn(tx, "node", node, id); err != nil {
+	if n, err := deletePrefixTxn(tx, dbChecks, "node_service", node, id); err != nil {
 		return err
 	} else if n > 0 {
-		if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
+		if err := setLastIndexTxn(tx, dbChecks, index); err != nil {
 			return err
 		}
-		defer s.watch[s.checkTable].Notify()
+		changedChecks = true
+	}
+	tx.Commit()
+	if changedServices {
+		s.notifyMutations(dbServices, node)
 	}
-	return tx.Commit()
+	if changedChecks {
+		s.notifyMutations(dbChecks, node)
+	}
+	return nil
 }
 
 // DeleteNode is used to delete a node and all it's services
 func (s *StateStore) DeleteNode(index uint64, node string) error {
-	tables := MDBTables{s.nodeTable, s.serviceTable, s.checkTable}
-	tx, err := tables.StartTxn(false)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
-	}
+	tx := s.db.Txn(true)
 	defer tx.Abort()
 
-	if n, err := s.serviceTable.DeleteTxn(tx, "id", node); err != nil {
+	if n, err := deletePrefixTxn(tx, dbServices, "node", node); err != nil {
 		return err
 	} else if n > 0 {
-		if err := s.serviceTable.SetLastIndexTxn(tx, index); err != nil {
+		if err := setLastIndexTxn(tx, dbServices, index); err != nil {
 			return err
 		}
-		defer s.watch[s.serviceTable].Notify()
+		defer s.notifyMutations(dbServices, node)
 	}
-	if n, err := s.checkTable.DeleteTxn(tx, "id", node); err != nil {
+	if n, err := deletePrefixTxn(tx, dbChecks, "node", node); err != nil {
 		return err
 	} else if n > 0 {
-		if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
+		if err := setLastIndexTxn(tx, dbChecks, index); err != nil {
 			return err
 		}
-		defer s.watch[s.checkTable].Notify()
+		defer s.notifyMutations(dbChecks, node)
 	}
-	if n, err := s.nodeTable.DeleteTxn(tx, "id", node); err != nil {
+	if raw, err := tx.First(dbNodes, "id", node); err != nil {
 		return err
-	} else if n > 0 {
-		if err := s.nodeTable.SetLastIndexTxn(tx, index); err != nil {
+	} else if raw != nil {
+		if err := tx.Delete(dbNodes, raw); err != nil {
 			return err
 		}
-		defer s.watch[s.nodeTable].Notify()
+		if err := setLastIndexTxn(tx, dbNodes, index); err != nil {
+			return err
+		}
+		defer s.notifyMutations(dbNodes, node)
 	}
-	return tx.Commit()
+	tx.Commit()
+	return nil
 }
 
+// deletePrefixTxn deletes every row matching the given index/args and
+// returns the number of rows removed
+func deletePrefixTxn(tx *memdb.Txn, table, index string, args ...interface{}) (int, error) {
+	iter, err := tx.Get(table, index, args...)
+	if err != nil {
+		return 0, err
+	}
+	var rows []interface{}
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		rows = append(rows, raw)
+	}
+	for _, row := range rows {
+		if err := tx.Delete(table, row); err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), nil
+}
+
+// servicesQuery backs Services
+func servicesQuery() *Query { return newQuery(dbServices, "id") }
+
 // Services is used to return all the services with a list of associated tags
 func (s *StateStore) Services() (uint64, map[string][]string) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	q := servicesQuery()
+	idx := lastIndexTxn(tx, q.Tables()...)
 	services := make(map[string][]string)
-	idx, res, err := s.serviceTable.Get("id")
+	iter, err := q.Iter(tx)
 	if err != nil {
 		s.logger.Printf("[ERR] consul.state: Failed to get services: %v", err)
 		return idx, services
 	}
-	for _, r := range res {
-		srv := r.(*structs.ServiceNode)
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		srv := raw.(*structs.ServiceNode)
 		tags, ok := services[srv.ServiceName]
 		if !ok {
 			services[srv.ServiceName] = make([]string, 0)
 		}
-
 		for _, tag := range srv.ServiceTags {
 			if !strContains(tags, tag) {
 				tags = append(tags, tag)
@@ -545,343 +748,410 @@ func (s *StateStore) Services() (uint64, map[string][]string) {
 	return idx, services
 }
 
-// ServiceNodes returns the nodes associated with a given service
-func (s *StateStore) ServiceNodes(service string) (uint64, structs.ServiceNodes) {
-	tables := s.queryTables["ServiceNodes"]
-	tx, err := tables.StartTxn(true)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
-	}
-	defer tx.Abort()
+// Query composes a single-index lookup with an optional in-memory
+// predicate, and records every table the result depends on. Every
+// exported StateStore read method except GetNode is backed by one of
+// these, built by a <method>Query constructor next to it, and Watch
+// subscribes to
+// exactly q.Tables() - so a query can't drift out of sync with what
+// Watch thinks it needs to watch the way the old hand-maintained
+// queryTables map could.
+type Query struct {
+	table   string
+	index   string
+	args    []interface{}
+	filter  func(interface{}) bool
+	touched []string
+}
 
-	idx, err := tables.LastIndexTxn(tx)
-	if err != nil {
-		panic(fmt.Errorf("Failed to get last index: %v", err))
-	}
+// newQuery starts a Query rooted at a table/index lookup. The root
+// table is always touched.
+func newQuery(table, index string, args ...interface{}) *Query {
+	return &Query{table: table, index: index, args: args, touched: []string{table}}
+}
 
-	res, err := s.serviceTable.GetTxn(tx, "service", service)
-	return idx, s.parseServiceNodes(tx, s.nodeTable, res, err)
+// Join records that tables also factor into this query's result, e.g.
+// CheckServiceNodes joins dbNodes and dbChecks onto the dbServices
+// rows it starts from. It does not perform the join itself - callers
+// still walk the joined tables against their txn - it only extends
+// the set Watch subscribes to.
+func (q *Query) Join(tables ...string) *Query {
+	q.touched = append(q.touched, tables...)
+	return q
 }
 
-// ServiceTagNodes returns the nodes associated with a given service matching a tag
-func (s *StateStore) ServiceTagNodes(service, tag string) (uint64, structs.ServiceNodes) {
-	tables := s.queryTables["ServiceNodes"]
-	tx, err := tables.StartTxn(true)
+// Tables returns every table this query's result depends on.
+func (q *Query) Tables() []string {
+	return q.touched
+}
+
+// Filter restricts the Query to rows for which pred returns true
+func (q *Query) Filter(pred func(interface{}) bool) *Query {
+	q.filter = pred
+	return q
+}
+
+// Iter executes the Query against a transaction, returning the raw
+// iterator for callers that want to walk (and side-effect on) results
+// one at a time rather than collecting them with Run.
+func (q *Query) Iter(tx *memdb.Txn) (memdb.ResultIterator, error) {
+	return tx.Get(q.table, q.index, q.args...)
+}
+
+// Run executes the Query against a transaction, returning the
+// matching rows
+func (q *Query) Run(tx *memdb.Txn) ([]interface{}, error) {
+	iter, err := q.Iter(tx)
 	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
+		return nil, err
 	}
-	defer tx.Abort()
+	var out []interface{}
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		if q.filter != nil && !q.filter(raw) {
+			continue
+		}
+		out = append(out, raw)
+	}
+	return out, nil
+}
 
-	idx, err := tables.LastIndexTxn(tx)
-	if err != nil {
-		panic(fmt.Errorf("Failed to get last index: %v", err))
+// serviceTagPredicate builds a Query filter that keeps only
+// ServiceNode rows carrying the given tag
+func serviceTagPredicate(tag string) func(interface{}) bool {
+	return func(raw interface{}) bool {
+		return strContains(raw.(*structs.ServiceNode).ServiceTags, tag)
 	}
+}
 
-	res, err := s.serviceTable.GetTxn(tx, "service", service)
-	res = serviceTagFilter(res, tag)
-	return idx, s.parseServiceNodes(tx, s.nodeTable, res, err)
+// serviceNodesQuery backs ServiceNodes
+func serviceNodesQuery(service string) *Query {
+	return newQuery(dbServices, "service", service).Join(dbNodes)
 }
 
-// serviceTagFilter is used to filter a list of *structs.ServiceNode which do
-// not have the specified tag
-func serviceTagFilter(l []interface{}, tag string) []interface{} {
-	n := len(l)
-	for i := 0; i < n; i++ {
-		srv := l[i].(*structs.ServiceNode)
-		if !strContains(srv.ServiceTags, tag) {
-			l[i], l[n-1] = l[n-1], nil
-			i--
-			n--
-		}
-	}
-	return l[:n]
+// serviceTagNodesQuery backs ServiceTagNodes
+func serviceTagNodesQuery(service, tag string) *Query {
+	return serviceNodesQuery(service).Filter(serviceTagPredicate(tag))
+}
+
+// ServiceNodes returns the nodes associated with a given service
+func (s *StateStore) ServiceNodes(service string) (uint64, structs.ServiceNodes) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	q := serviceNodesQuery(service)
+	idx := lastIndexTxn(tx, q.Tables()...)
+	res, err := q.Run(tx)
+	return idx, s.parseServiceNodes(tx, res, err)
+}
+
+// ServiceTagNodes returns the nodes associated with a given service matching a tag
+func (s *StateStore) ServiceTagNodes(service, tag string) (uint64, structs.ServiceNodes) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	q := serviceTagNodesQuery(service, tag)
+	idx := lastIndexTxn(tx, q.Tables()...)
+	res, err := q.Run(tx)
+	return idx, s.parseServiceNodes(tx, res, err)
 }
 
-// parseServiceNodes parses results ServiceNodes and ServiceTagNodes
-func (s *StateStore) parseServiceNodes(tx *MDBTxn, table *MDBTable, res []interface{}, err error) structs.ServiceNodes {
-	nodes := make(structs.ServiceNodes, len(res))
+// parseServiceNodes parses results of ServiceNodes and ServiceTagNodes
+func (s *StateStore) parseServiceNodes(tx *memdb.Txn, res []interface{}, err error) structs.ServiceNodes {
+	var nodes structs.ServiceNodes
 	if err != nil {
 		s.logger.Printf("[ERR] consul.state: Failed to get service nodes: %v", err)
 		return nodes
 	}
 
-	for i, r := range res {
-		srv := r.(*structs.ServiceNode)
+	for _, raw := range res {
+		srv := *raw.(*structs.ServiceNode)
 
-		// Get the address of the node
-		nodeRes, err := table.GetTxn(tx, "id", srv.Node)
-		if err != nil || len(nodeRes) != 1 {
-			s.logger.Printf("[ERR] consul.state: Failed to join service node %#v with node: %v", *srv, err)
+		nodeRaw, err := tx.First(dbNodes, "id", srv.Node)
+		if err != nil || nodeRaw == nil {
+			s.logger.Printf("[ERR] consul.state: Failed to join service node %#v with node: %v", srv, err)
 			continue
 		}
-		srv.Address = nodeRes[0].(*structs.Node).Address
-
-		nodes[i] = *srv
+		srv.Address = nodeRaw.(*structs.Node).Address
+		nodes = append(nodes, srv)
 	}
-
 	return nodes
 }
 
 // EnsureCheck is used to create a check or updates it's state
 func (s *StateStore) EnsureCheck(index uint64, check *structs.HealthCheck) error {
-	// Ensure we have a status
 	if check.Status == "" {
 		check.Status = structs.HealthUnknown
 	}
 
-	// Start the txn
-	tables := MDBTables{s.nodeTable, s.serviceTable, s.checkTable}
-	tx, err := tables.StartTxn(false)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
-	}
+	tx := s.db.Txn(true)
 	defer tx.Abort()
 
-	// Ensure the node exists
-	res, err := s.nodeTable.GetTxn(tx, "id", check.Node)
+	raw, err := tx.First(dbNodes, "id", check.Node)
 	if err != nil {
 		return err
 	}
-	if len(res) == 0 {
+	if raw == nil {
 		return fmt.Errorf("Missing node registration")
 	}
 
-	// Ensure the service exists if specified
 	if check.ServiceID != "" {
-		res, err = s.serviceTable.GetTxn(tx, "id", check.Node, check.ServiceID)
+		raw, err = tx.First(dbServices, "id", check.Node, check.ServiceID)
 		if err != nil {
 			return err
 		}
-		if len(res) == 0 {
+		if raw == nil {
 			return fmt.Errorf("Missing service registration")
 		}
-		// Ensure we set the correct service
-		srv := res[0].(*structs.ServiceNode)
+		srv := raw.(*structs.ServiceNode)
 		check.ServiceName = srv.ServiceName
 	}
 
-	// Ensure the check is set
-	if err := s.checkTable.InsertTxn(tx, check); err != nil {
-		return err
+	if err := tx.Insert(dbChecks, check); err != nil {
+		return fmt.Errorf("failed inserting check: %v", err)
 	}
-	if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
+	if err := setLastIndexTxn(tx, dbChecks, index); err != nil {
 		return err
 	}
-	defer s.watch[s.checkTable].Notify()
-	return tx.Commit()
+	tx.Commit()
+	s.notifyMutations(dbChecks, check.Node)
+	return nil
 }
 
 // DeleteNodeCheck is used to delete a node health check
 func (s *StateStore) DeleteNodeCheck(index uint64, node, id string) error {
-	tx, err := s.checkTable.StartTxn(false, nil)
-	if err != nil {
-		return err
-	}
+	tx := s.db.Txn(true)
 	defer tx.Abort()
 
-	if n, err := s.checkTable.DeleteTxn(tx, "id", node, id); err != nil {
+	if n, err := deletePrefixTxn(tx, dbChecks, "id", node, id); err != nil {
 		return err
 	} else if n > 0 {
-		if err := s.checkTable.SetLastIndexTxn(tx, index); err != nil {
+		if err := setLastIndexTxn(tx, dbChecks, index); err != nil {
 			return err
 		}
-		defer s.watch[s.checkTable].Notify()
+		tx.Commit()
+		s.notifyMutations(dbChecks, node)
+		return nil
 	}
-	return tx.Commit()
+	tx.Commit()
+	return nil
 }
 
+// nodeChecksQuery backs NodeChecks
+func nodeChecksQuery(node string) *Query { return newQuery(dbChecks, "node", node) }
+
+// serviceChecksQuery backs ServiceChecks
+func serviceChecksQuery(service string) *Query { return newQuery(dbChecks, "service", service) }
+
+// checksInStateQuery backs ChecksInState
+func checksInStateQuery(state string) *Query { return newQuery(dbChecks, "status", state) }
+
 // NodeChecks is used to get all the checks for a node
 func (s *StateStore) NodeChecks(node string) (uint64, structs.HealthChecks) {
-	return s.parseHealthChecks(s.checkTable.Get("id", node))
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+	q := nodeChecksQuery(node)
+	iter, err := q.Iter(tx)
+	return lastIndexTxn(tx, q.Tables()...), s.parseHealthChecks(iter, err)
 }
 
 // ServiceChecks is used to get all the checks for a service
 func (s *StateStore) ServiceChecks(service string) (uint64, structs.HealthChecks) {
-	return s.parseHealthChecks(s.checkTable.Get("service", service))
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+	q := serviceChecksQuery(service)
+	iter, err := q.Iter(tx)
+	return lastIndexTxn(tx, q.Tables()...), s.parseHealthChecks(iter, err)
 }
 
-// CheckInState is used to get all the checks for a service in a given state
+// ChecksInState is used to get all the checks for a service in a given state
 func (s *StateStore) ChecksInState(state string) (uint64, structs.HealthChecks) {
-	return s.parseHealthChecks(s.checkTable.Get("status", state))
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+	q := checksInStateQuery(state)
+	iter, err := q.Iter(tx)
+	return lastIndexTxn(tx, q.Tables()...), s.parseHealthChecks(iter, err)
 }
 
-// parseHealthChecks is used to handle the resutls of a Get against
-// the checkTable
-func (s *StateStore) parseHealthChecks(idx uint64, res []interface{}, err error) (uint64, structs.HealthChecks) {
-	results := make([]*structs.HealthCheck, len(res))
+// parseHealthChecks is used to handle the results of a Get against
+// the checks table
+func (s *StateStore) parseHealthChecks(iter memdb.ResultIterator, err error) structs.HealthChecks {
+	var results structs.HealthChecks
 	if err != nil {
 		s.logger.Printf("[ERR] consul.state: Failed to get health checks: %v", err)
-		return idx, results
+		return results
 	}
-	for i, r := range res {
-		results[i] = r.(*structs.HealthCheck)
+	if iter == nil {
+		return results
 	}
-	return idx, results
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		results = append(results, raw.(*structs.HealthCheck))
+	}
+	return results
+}
+
+// checkServiceNodesQuery backs CheckServiceNodes
+func checkServiceNodesQuery(service string) *Query {
+	return newQuery(dbServices, "service", service).Join(dbNodes, dbChecks)
+}
+
+// checkServiceTagNodesQuery backs CheckServiceTagNodes
+func checkServiceTagNodesQuery(service, tag string) *Query {
+	return checkServiceNodesQuery(service).Filter(serviceTagPredicate(tag))
 }
 
 // CheckServiceNodes returns the nodes associated with a given service, along
 // with any associated check
 func (s *StateStore) CheckServiceNodes(service string) (uint64, structs.CheckServiceNodes) {
-	tables := s.queryTables["CheckServiceNodes"]
-	tx, err := tables.StartTxn(true)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
-	}
+	tx := s.db.Txn(false)
 	defer tx.Abort()
 
-	idx, err := tables.LastIndexTxn(tx)
-	if err != nil {
-		panic(fmt.Errorf("Failed to get last index: %v", err))
-	}
-
-	res, err := s.serviceTable.GetTxn(tx, "service", service)
+	q := checkServiceNodesQuery(service)
+	idx := lastIndexTxn(tx, q.Tables()...)
+	res, err := q.Run(tx)
 	return idx, s.parseCheckServiceNodes(tx, res, err)
 }
 
-// CheckServiceNodes returns the nodes associated with a given service, along
+// CheckServiceTagNodes returns the nodes associated with a given service, along
 // with any associated checks
 func (s *StateStore) CheckServiceTagNodes(service, tag string) (uint64, structs.CheckServiceNodes) {
-	tables := s.queryTables["CheckServiceNodes"]
-	tx, err := tables.StartTxn(true)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
-	}
+	tx := s.db.Txn(false)
 	defer tx.Abort()
 
-	idx, err := tables.LastIndexTxn(tx)
-	if err != nil {
-		panic(fmt.Errorf("Failed to get last index: %v", err))
-	}
-
-	res, err := s.serviceTable.GetTxn(tx, "service", service)
-	res = serviceTagFilter(res, tag)
+	q := checkServiceTagNodesQuery(service, tag)
+	idx := lastIndexTxn(tx, q.Tables()...)
+	res, err := q.Run(tx)
 	return idx, s.parseCheckServiceNodes(tx, res, err)
 }
 
-// parseCheckServiceNodes parses results CheckServiceNodes and CheckServiceTagNodes
-func (s *StateStore) parseCheckServiceNodes(tx *MDBTxn, res []interface{}, err error) structs.CheckServiceNodes {
-	nodes := make(structs.CheckServiceNodes, len(res))
+// parseCheckServiceNodes parses results of CheckServiceNodes and CheckServiceTagNodes
+func (s *StateStore) parseCheckServiceNodes(tx *memdb.Txn, res []interface{}, err error) structs.CheckServiceNodes {
+	var nodes structs.CheckServiceNodes
 	if err != nil {
 		s.logger.Printf("[ERR] consul.state: Failed to get service nodes: %v", err)
 		return nodes
 	}
 
-	for i, r := range res {
-		srv := r.(*structs.ServiceNode)
+	for _, raw := range res {
+		srv := raw.(*structs.ServiceNode)
 
-		// Get the node
-		nodeRes, err := s.nodeTable.GetTxn(tx, "id", srv.Node)
-		if err != nil || len(nodeRes) != 1 {
+		nodeRaw, err := tx.First(dbNodes, "id", srv.Node)
+		if err != nil || nodeRaw == nil {
 			s.logger.Printf("[ERR] consul.state: Failed to join service node %#v with node: %v", *srv, err)
 			continue
 		}
 
-		// Get any associated checks of the service
-		res, err := s.checkTable.GetTxn(tx, "node", srv.Node, srv.ServiceID)
-		_, checks := s.parseHealthChecks(0, res, err)
+		checkIter, err := tx.Get(dbChecks, "node_service", srv.Node, srv.ServiceID)
+		checks := s.parseHealthChecks(checkIter, err)
 
-		// Get any checks of the node, not assciated with any service
-		res, err = s.checkTable.GetTxn(tx, "node", srv.Node, "")
-		_, nodeChecks := s.parseHealthChecks(0, res, err)
-		checks = append(checks, nodeChecks...)
+		// Node-wide checks (e.g. serfHealth) are stored with an empty
+		// ServiceID, so they can't be reached through node_service: an
+		// AllowMissing compound index stores that row's key as
+		// "<node>\x00" while FromArgs(node, "") encodes a lookup key of
+		// "<node>\x00\x00", which never matches. Walk the single-field
+		// node index instead and keep only the service-less rows.
+		nodeCheckIter, err := tx.Get(dbChecks, "node", srv.Node)
+		if err != nil {
+			s.logger.Printf("[ERR] consul.state: Failed to get node checks: %v", err)
+		} else {
+			for raw := nodeCheckIter.Next(); raw != nil; raw = nodeCheckIter.Next() {
+				check := raw.(*structs.HealthCheck)
+				if check.ServiceID == "" {
+					checks = append(checks, check)
+				}
+			}
+		}
 
-		// Setup the node
-		nodes[i].Node = *nodeRes[0].(*structs.Node)
-		nodes[i].Service = structs.NodeService{
+		var entry structs.CheckServiceNode
+		entry.Node = *nodeRaw.(*structs.Node)
+		entry.Service = structs.NodeService{
 			ID:      srv.ServiceID,
 			Service: srv.ServiceName,
 			Tags:    srv.ServiceTags,
 			Port:    srv.ServicePort,
 		}
-		nodes[i].Checks = checks
+		entry.Checks = checks
+		nodes = append(nodes, entry)
 	}
 
 	return nodes
 }
 
+// nodeInfoQuery backs NodeInfo
+func nodeInfoQuery(node string) *Query {
+	return newQuery(dbNodes, "id", node).Join(dbServices, dbChecks)
+}
+
+// nodeDumpQuery backs NodeDump
+func nodeDumpQuery() *Query {
+	return newQuery(dbNodes, "id").Join(dbServices, dbChecks)
+}
+
 // NodeInfo is used to generate the full info about a node.
 func (s *StateStore) NodeInfo(node string) (uint64, structs.NodeDump) {
-	tables := s.queryTables["NodeInfo"]
-	tx, err := tables.StartTxn(true)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
-	}
+	tx := s.db.Txn(false)
 	defer tx.Abort()
 
-	idx, err := tables.LastIndexTxn(tx)
-	if err != nil {
-		panic(fmt.Errorf("Failed to get last index: %v", err))
-	}
-
-	res, err := s.nodeTable.GetTxn(tx, "id", node)
-	return idx, s.parseNodeInfo(tx, res, err)
+	q := nodeInfoQuery(node)
+	idx := lastIndexTxn(tx, q.Tables()...)
+	iter, err := q.Iter(tx)
+	return idx, s.parseNodeInfo(tx, iter, err)
 }
 
 // NodeDump is used to generate the NodeInfo for all nodes. This is very expensive,
 // and should generally be avoided for programatic access.
 func (s *StateStore) NodeDump() (uint64, structs.NodeDump) {
-	tables := s.queryTables["NodeDump"]
-	tx, err := tables.StartTxn(true)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
-	}
+	tx := s.db.Txn(false)
 	defer tx.Abort()
 
-	idx, err := tables.LastIndexTxn(tx)
-	if err != nil {
-		panic(fmt.Errorf("Failed to get last index: %v", err))
-	}
-
-	res, err := s.nodeTable.GetTxn(tx, "id")
-	return idx, s.parseNodeInfo(tx, res, err)
+	q := nodeDumpQuery()
+	idx := lastIndexTxn(tx, q.Tables()...)
+	iter, err := q.Iter(tx)
+	return idx, s.parseNodeInfo(tx, iter, err)
 }
 
 // parseNodeInfo is used to scan over the results of a node
 // iteration and generate a NodeDump
-func (s *StateStore) parseNodeInfo(tx *MDBTxn, res []interface{}, err error) structs.NodeDump {
-	dump := make(structs.NodeDump, 0, len(res))
+func (s *StateStore) parseNodeInfo(tx *memdb.Txn, iter memdb.ResultIterator, err error) structs.NodeDump {
+	var dump structs.NodeDump
 	if err != nil {
 		s.logger.Printf("[ERR] consul.state: Failed to get nodes: %v", err)
 		return dump
 	}
+	if iter == nil {
+		return dump
+	}
 
-	for _, r := range res {
-		// Copy the address and node
-		node := r.(*structs.Node)
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		node := raw.(*structs.Node)
 		info := &structs.NodeInfo{
 			Node:    node.Node,
 			Address: node.Address,
 		}
 
-		// Get any services of the node
-		res, err = s.serviceTable.GetTxn(tx, "id", node.Node)
+		svcIter, err := tx.Get(dbServices, "node", node.Node)
 		if err != nil {
 			s.logger.Printf("[ERR] consul.state: Failed to get node services: %v", err)
-		}
-		info.Services = make([]*structs.NodeService, 0, len(res))
-		for _, r := range res {
-			service := r.(*structs.ServiceNode)
-			srv := &structs.NodeService{
-				ID:      service.ServiceID,
-				Service: service.ServiceName,
-				Tags:    service.ServiceTags,
-				Port:    service.ServicePort,
+		} else {
+			for raw := svcIter.Next(); raw != nil; raw = svcIter.Next() {
+				service := raw.(*structs.ServiceNode)
+				info.Services = append(info.Services, &structs.NodeService{
+					ID:      service.ServiceID,
+					Service: service.ServiceName,
+					Tags:    service.ServiceTags,
+					Port:    service.ServicePort,
+				})
 			}
-			info.Services = append(info.Services, srv)
 		}
 
-		// Get any checks of the node
-		res, err = s.checkTable.GetTxn(tx, "node", node.Node)
+		chkIter, err := tx.Get(dbChecks, "node", node.Node)
 		if err != nil {
 			s.logger.Printf("[ERR] consul.state: Failed to get node checks: %v", err)
-		}
-		info.Checks = make([]*structs.HealthCheck, 0, len(res))
-		for _, r := range res {
-			chk := r.(*structs.HealthCheck)
-			info.Checks = append(info.Checks, chk)
+		} else {
+			for raw := chkIter.Next(); raw != nil; raw = chkIter.Next() {
+				info.Checks = append(info.Checks, raw.(*structs.HealthCheck))
+			}
 		}
 
-		// Add the node info
 		dump = append(dump, info)
 	}
 	return dump
@@ -889,122 +1159,191 @@ func (s *StateStore) parseNodeInfo(tx *MDBTxn, res []interface{}, err error) str
 
 // KVSSet is used to create or update a KV entry
 func (s *StateStore) KVSSet(index uint64, d *structs.DirEntry) error {
-	// Start a new txn
-	tx, err := s.kvsTable.StartTxn(false, nil)
-	if err != nil {
-		return err
-	}
+	tx := s.db.Txn(true)
 	defer tx.Abort()
 
-	// Get the existing node
-	res, err := s.kvsTable.GetTxn(tx, "id", d.Key)
+	raw, err := tx.First(dbKVS, "id", d.Key)
 	if err != nil {
 		return err
 	}
 
-	// Set the create and modify times
-	if len(res) == 0 {
+	if raw == nil {
 		d.CreateIndex = index
 	} else {
-		d.CreateIndex = res[0].(*structs.DirEntry).CreateIndex
+		d.CreateIndex = raw.(*structs.DirEntry).CreateIndex
 	}
 	d.ModifyIndex = index
 
-	if err := s.kvsTable.InsertTxn(tx, d); err != nil {
-		return err
+	if err := tx.Insert(dbKVS, d); err != nil {
+		return fmt.Errorf("failed inserting kvs entry: %v", err)
 	}
-	if err := s.kvsTable.SetLastIndexTxn(tx, index); err != nil {
+	if err := setLastIndexTxn(tx, dbKVS, index); err != nil {
 		return err
 	}
-	defer s.watch[s.kvsTable].Notify()
-	return tx.Commit()
+	tx.Commit()
+	s.notifyMutations(dbKVS, d.Key)
+	return nil
 }
 
 // KVSRestore is used to restore a DirEntry. It should only be used when
 // doing a restore, otherwise KVSSet should be used.
 func (s *StateStore) KVSRestore(d *structs.DirEntry) error {
-	// Start a new txn
-	tx, err := s.kvsTable.StartTxn(false, nil)
-	if err != nil {
-		return err
-	}
+	tx := s.db.Txn(true)
 	defer tx.Abort()
 
-	if err := s.kvsTable.InsertTxn(tx, d); err != nil {
-		return err
+	if err := tx.Insert(dbKVS, d); err != nil {
+		return fmt.Errorf("failed inserting kvs entry: %v", err)
 	}
-	return tx.Commit()
+	tx.Commit()
+	return nil
 }
 
+// kvsGetQuery backs KVSGet
+func kvsGetQuery(key string) *Query { return newQuery(dbKVS, "id", key) }
+
+// kvsListQuery backs KVSList and KVSListKeysIter
+func kvsListQuery(prefix string) *Query { return newQuery(dbKVS, "id_prefix", prefix) }
+
 // KVSGet is used to get a KV entry
 func (s *StateStore) KVSGet(key string) (uint64, *structs.DirEntry, error) {
-	idx, res, err := s.kvsTable.Get("id", key)
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	q := kvsGetQuery(key)
+	idx := lastIndexTxn(tx, q.Tables()...)
+	raw, err := tx.First(q.table, q.index, q.args...)
+	if err != nil {
+		return idx, nil, err
+	}
 	var d *structs.DirEntry
-	if len(res) > 0 {
-		d = res[0].(*structs.DirEntry)
+	if raw != nil {
+		d = raw.(*structs.DirEntry)
 	}
-	return idx, d, err
+	return idx, d, nil
 }
 
 // KVSList is used to list all KV entries with a prefix
 func (s *StateStore) KVSList(prefix string) (uint64, structs.DirEntries, error) {
-	idx, res, err := s.kvsTable.Get("id_prefix", prefix)
-	ents := make(structs.DirEntries, len(res))
-	for idx, r := range res {
-		ents[idx] = r.(*structs.DirEntry)
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+
+	q := kvsListQuery(prefix)
+	idx := lastIndexTxn(tx, q.Tables()...)
+	iter, err := q.Iter(tx)
+	if err != nil {
+		return idx, nil, err
+	}
+	var ents structs.DirEntries
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		ents = append(ents, raw.(*structs.DirEntry))
 	}
-	return idx, ents, err
+	return idx, ents, nil
 }
 
-// KVSListKeys is used to list keys with a prefix, and up to a given seperator
+// KVSListKeys is used to list keys with a prefix, and up to a given
+// seperator. It fully materializes the result, so callers that can
+// instead consume keys one at a time (e.g. an RPC handler chunking a
+// KV.List response) should use KVSListKeysIter directly - that wiring
+// belongs in this package's RPC endpoint, which doesn't exist yet in
+// this tree.
 func (s *StateStore) KVSListKeys(prefix, seperator string) (uint64, []string, error) {
-	tx, err := s.kvsTable.StartTxn(true, nil)
+	idx, iter, err := s.KVSListKeysIter(prefix, seperator)
 	if err != nil {
-		return 0, nil, err
+		return idx, nil, err
 	}
-	defer tx.Abort()
+	defer iter.Close()
 
-	idx, err := s.kvsTable.LastIndexTxn(tx)
-	if err != nil {
-		return 0, nil, err
+	var keys []string
+	for {
+		key, ok := iter.Next()
+		if !ok {
+			break
+		}
+		keys = append(keys, key)
 	}
+	return idx, keys, nil
+}
 
-	// Aggregate the stream
-	stream := make(chan interface{}, 128)
-	done := make(chan struct{})
-	var keys []string
-	go func() {
-		prefixLen := len(prefix)
-		sepLen := len(seperator)
-		last := ""
-		for raw := range stream {
-			ent := raw.(*structs.DirEntry)
-			after := ent.Key[prefixLen:]
-
-			// If there is no seperator, always accumulate
-			if sepLen == 0 {
-				keys = append(keys, ent.Key)
-				continue
-			}
+// KeyIterator is a cursor over a stream of KVS keys. It is opened
+// under a single memdb read transaction and lazily decodes each
+// DirEntry's key only as Next is called, so callers that stop early
+// (e.g. an RPC client that disconnects mid-list) never pay to
+// materialize the remainder of a large KV tree.
+type KeyIterator struct {
+	tx        *memdb.Txn
+	iter      memdb.ResultIterator
+	prefixLen int
+	sepLen    int
+	seperator string
+	last      string
+	closed    bool
+}
 
-			// Check for the seperator
-			if idx := strings.Index(after, seperator); idx >= 0 {
-				toSep := ent.Key[:prefixLen+idx+sepLen]
-				if last != toSep {
-					keys = append(keys, toSep)
-					last = toSep
-				}
-			} else {
-				keys = append(keys, ent.Key)
+// Next returns the next key in the stream, collapsing any run of keys
+// that share a common segment up to the next seperator into a single
+// entry, mirroring the semantics of the old KVSListKeys. It returns
+// ok == false once the stream is exhausted.
+func (k *KeyIterator) Next() (string, bool) {
+	for {
+		raw := k.iter.Next()
+		if raw == nil {
+			return "", false
+		}
+		ent := raw.(*structs.DirEntry)
+		if k.sepLen == 0 {
+			return ent.Key, true
+		}
+
+		after := ent.Key[k.prefixLen:]
+		if i := strings.Index(after, k.seperator); i >= 0 {
+			toSep := ent.Key[:k.prefixLen+i+k.sepLen]
+			if k.last == toSep {
+				continue
 			}
+			k.last = toSep
+			return toSep, true
 		}
-		close(done)
-	}()
+		return ent.Key, true
+	}
+}
+
+// Close releases the underlying read transaction. Safe to call more
+// than once.
+func (k *KeyIterator) Close() error {
+	if !k.closed {
+		k.tx.Abort()
+		k.closed = true
+	}
+	return nil
+}
 
-	// Start the stream, and wait for completion
-	err = s.kvsTable.StreamTxn(stream, tx, "id_prefix", prefix)
-	<-done
-	return idx, keys, err
+// KVSListKeysIter returns a streaming cursor over the keys under a
+// prefix, collapsed at seperator boundaries. The returned iterator
+// holds open a single read transaction against a frozen snapshot of
+// the kvs radix tree; the caller must Close it when done.
+//
+// This is the entry point an RPC handler should use to chunk a large
+// KV.List response instead of calling KVSListKeys, which fully
+// materializes the result. No such handler exists in this package
+// yet; KVSListKeys is still the only caller.
+func (s *StateStore) KVSListKeysIter(prefix, seperator string) (uint64, *KeyIterator, error) {
+	tx := s.db.Txn(false)
+	q := kvsListQuery(prefix)
+	idx := lastIndexTxn(tx, q.Tables()...)
+
+	iter, err := q.Iter(tx)
+	if err != nil {
+		tx.Abort()
+		return 0, nil, err
+	}
+
+	return idx, &KeyIterator{
+		tx:        tx,
+		iter:      iter,
+		prefixLen: len(prefix),
+		sepLen:    len(seperator),
+		seperator: seperator,
+	}, nil
 }
 
 // KVSDelete is used to delete a KVS entry
@@ -1022,46 +1361,47 @@ func (s *StateStore) KVSDeleteTree(index uint64, prefix string) error {
 
 // kvsDeleteWithIndex does a delete with either the id or id_prefix
 func (s *StateStore) kvsDeleteWithIndex(index uint64, tableIndex string, parts ...string) error {
-	// Start a new txn
-	tx, err := s.kvsTable.StartTxn(false, nil)
-	if err != nil {
-		return err
-	}
+	tx := s.db.Txn(true)
 	defer tx.Abort()
 
-	num, err := s.kvsTable.DeleteTxn(tx, tableIndex, parts...)
+	args := make([]interface{}, len(parts))
+	for i, p := range parts {
+		args[i] = p
+	}
+	num, err := deletePrefixTxn(tx, dbKVS, tableIndex, args...)
 	if err != nil {
 		return err
 	}
 
 	if num > 0 {
-		if err := s.kvsTable.SetLastIndexTxn(tx, index); err != nil {
+		if err := setLastIndexTxn(tx, dbKVS, index); err != nil {
 			return err
 		}
-		defer s.watch[s.kvsTable].Notify()
+		tx.Commit()
+		if len(parts) > 0 {
+			s.notifyMutations(dbKVS, parts[0])
+		} else {
+			s.notifyMutations(dbKVS, "")
+		}
+		return nil
 	}
-	return tx.Commit()
+	tx.Commit()
+	return nil
 }
 
 // KVSCheckAndSet is used to perform an atomic check-and-set
 func (s *StateStore) KVSCheckAndSet(index uint64, d *structs.DirEntry) (bool, error) {
-	// Start a new txn
-	tx, err := s.kvsTable.StartTxn(false, nil)
-	if err != nil {
-		return false, err
-	}
+	tx := s.db.Txn(true)
 	defer tx.Abort()
 
-	// Get the existing node
-	res, err := s.kvsTable.GetTxn(tx, "id", d.Key)
+	raw, err := tx.First(dbKVS, "id", d.Key)
 	if err != nil {
 		return false, err
 	}
 
-	// Get the existing node if any
 	var exist *structs.DirEntry
-	if len(res) > 0 {
-		exist = res[0].(*structs.DirEntry)
+	if raw != nil {
+		exist = raw.(*structs.DirEntry)
 	}
 
 	// Use the ModifyIndex as the constraint. A modify of time of 0
@@ -1073,7 +1413,6 @@ func (s *StateStore) KVSCheckAndSet(index uint64, d *structs.DirEntry) (bool, er
 		return false, nil
 	}
 
-	// Set the create and modify times
 	if exist == nil {
 		d.CreateIndex = index
 	} else {
@@ -1081,153 +1420,516 @@ func (s *StateStore) KVSCheckAndSet(index uint64, d *structs.DirEntry) (bool, er
 	}
 	d.ModifyIndex = index
 
-	if err := s.kvsTable.InsertTxn(tx, d); err != nil {
+	if err := tx.Insert(dbKVS, d); err != nil {
+		return false, fmt.Errorf("failed inserting kvs entry: %v", err)
+	}
+	if err := setLastIndexTxn(tx, dbKVS, index); err != nil {
+		return false, err
+	}
+	tx.Commit()
+	s.notifyMutations(dbKVS, d.Key)
+	return true, nil
+}
+
+// KVSLock is used to acquire a lock on a KV entry on behalf of a
+// session. It succeeds if the key is currently unheld, or already
+// held by the same session (a renewal); any other case returns
+// (false, nil) rather than an error so the caller can report a
+// normal "not acquired" result. A key still inside another session's
+// lock-delay window is rejected the same way.
+func (s *StateStore) KVSLock(index uint64, d *structs.DirEntry) (bool, error) {
+	if s.KVSLockDelay(d.Key) > 0 {
+		return false, nil
+	}
+
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	raw, err := tx.First(dbKVS, "id", d.Key)
+	if err != nil {
 		return false, err
 	}
-	if err := s.kvsTable.SetLastIndexTxn(tx, index); err != nil {
+
+	var exist *structs.DirEntry
+	if raw != nil {
+		exist = raw.(*structs.DirEntry)
+	}
+	if exist != nil && exist.Session != "" && exist.Session != d.Session {
+		return false, nil
+	}
+
+	if exist == nil {
+		d.CreateIndex = index
+		d.LockIndex = 1
+	} else {
+		d.CreateIndex = exist.CreateIndex
+		d.LockIndex = exist.LockIndex
+		if exist.Session != d.Session {
+			d.LockIndex++
+		}
+	}
+	d.ModifyIndex = index
+
+	if err := tx.Insert(dbKVS, d); err != nil {
+		return false, fmt.Errorf("failed inserting kvs entry: %v", err)
+	}
+	if err := setLastIndexTxn(tx, dbKVS, index); err != nil {
+		return false, err
+	}
+	tx.Commit()
+	s.notifyMutations(dbKVS, d.Key)
+	return true, nil
+}
+
+// KVSUnlock releases a lock on a KV entry held by the given session.
+// It returns (false, nil) if the key isn't held, or is held by a
+// different session.
+func (s *StateStore) KVSUnlock(index uint64, d *structs.DirEntry) (bool, error) {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	raw, err := tx.First(dbKVS, "id", d.Key)
+	if err != nil {
+		return false, err
+	}
+	if raw == nil {
+		return false, nil
+	}
+	exist := raw.(*structs.DirEntry)
+	if exist.Session != d.Session {
+		return false, nil
+	}
+
+	d.CreateIndex = exist.CreateIndex
+	d.LockIndex = exist.LockIndex
+	d.Session = ""
+	d.ModifyIndex = index
+
+	if err := tx.Insert(dbKVS, d); err != nil {
+		return false, fmt.Errorf("failed inserting kvs entry: %v", err)
+	}
+	if err := setLastIndexTxn(tx, dbKVS, index); err != nil {
 		return false, err
 	}
-	defer s.watch[s.kvsTable].Notify()
-	return true, tx.Commit()
+	tx.Commit()
+	s.notifyMutations(dbKVS, d.Key)
+	return true, nil
+}
+
+// KVSLockDelay returns the remaining lock-delay for a key, or zero
+// if the key may be acquired immediately.
+func (s *StateStore) KVSLockDelay(key string) time.Duration {
+	s.lockDelayLock.Lock()
+	defer s.lockDelayLock.Unlock()
+
+	expires, ok := s.lockDelay[key]
+	if !ok {
+		return 0
+	}
+	remaining := expires.Sub(time.Now())
+	if remaining <= 0 {
+		delete(s.lockDelay, key)
+		return 0
+	}
+	return remaining
+}
+
+// setLockDelay records that key may not be re-acquired until delay
+// has elapsed.
+func (s *StateStore) setLockDelay(key string, delay time.Duration) {
+	s.lockDelayLock.Lock()
+	defer s.lockDelayLock.Unlock()
+	s.lockDelay[key] = time.Now().Add(delay)
+}
+
+// releaseSessionLocksTxn clears the Session field of every KV entry
+// held by sessionID, returning the keys that were released so the
+// caller can apply lock-delay and fire the per-key watches.
+func (s *StateStore) releaseSessionLocksTxn(tx *memdb.Txn, index uint64, sessionID string) ([]string, error) {
+	iter, err := tx.Get(dbKVS, "session", sessionID)
+	if err != nil {
+		return nil, err
+	}
+	var held []*structs.DirEntry
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		held = append(held, raw.(*structs.DirEntry))
+	}
+
+	keys := make([]string, 0, len(held))
+	for _, d := range held {
+		released := *d
+		released.Session = ""
+		released.ModifyIndex = index
+		if err := tx.Insert(dbKVS, &released); err != nil {
+			return nil, err
+		}
+		keys = append(keys, released.Key)
+	}
+	return keys, nil
 }
 
 // SessionCreate is used to create a new session. The
 // ID will be populated on a successful return
 func (s *StateStore) SessionCreate(index uint64, session *structs.Session) error {
-	// Assign the create index
 	session.CreateIndex = index
 
-	// Start the transaction
-	tables := MDBTables{s.nodeTable, s.checkTable,
-		s.sessionTable, s.sessionCheckTable}
-	tx, err := tables.StartTxn(false)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
-	}
+	tx := s.db.Txn(true)
 	defer tx.Abort()
 
-	// Verify that the node exists
-	res, err := s.nodeTable.GetTxn(tx, "id", session.Node)
+	raw, err := tx.First(dbNodes, "id", session.Node)
 	if err != nil {
 		return err
 	}
-	if len(res) == 0 {
+	if raw == nil {
 		return fmt.Errorf("Missing node registration")
 	}
 
-	// Verify that the checks exist and are not critical
-	for _, checkId := range session.Checks {
-		res, err := s.checkTable.GetTxn(tx, "id", session.Node, checkId)
+	for _, checkID := range session.Checks {
+		raw, err := tx.First(dbChecks, "id", session.Node, checkID)
 		if err != nil {
 			return err
 		}
-		if len(res) == 0 {
-			return fmt.Errorf("Missing check '%s' registration", checkId)
+		if raw == nil {
+			return fmt.Errorf("Missing check '%s' registration", checkID)
 		}
-		chk := res[0].(*structs.HealthCheck)
+		chk := raw.(*structs.HealthCheck)
 		if chk.Status == structs.HealthCritical {
-			return fmt.Errorf("Check '%s' is in %s state", checkId, chk.Status)
+			return fmt.Errorf("Check '%s' is in %s state", checkID, chk.Status)
 		}
 	}
 
 	// Generate a new session ID, verify uniqueness
 	session.ID = generateUUID()
 	for {
-		res, err = s.sessionTable.GetTxn(tx, "id", session.ID)
+		raw, err = tx.First(dbSessions, "id", session.ID)
 		if err != nil {
 			return err
 		}
-		// Quit if this ID is unique
-		if len(res) == 0 {
+		if raw == nil {
 			break
 		}
+		session.ID = generateUUID()
 	}
 
-	// Insert the session
-	if err := s.sessionTable.InsertTxn(tx, session); err != nil {
-		return err
+	session.LastRenewal = time.Now()
+
+	if err := tx.Insert(dbSessions, session); err != nil {
+		return fmt.Errorf("failed inserting session: %v", err)
 	}
 
-	// Insert the check mappings
 	sCheck := sessionCheck{Node: session.Node, Session: session.ID}
 	for _, checkID := range session.Checks {
 		sCheck.CheckID = checkID
-		if err := s.sessionCheckTable.InsertTxn(tx, &sCheck); err != nil {
-			return err
+		entry := sCheck
+		if err := tx.Insert(dbSessionChecks, &entry); err != nil {
+			return fmt.Errorf("failed inserting session check: %v", err)
 		}
 	}
 
-	// Trigger the update notifications
-	if err := s.sessionTable.SetLastIndexTxn(tx, index); err != nil {
+	if err := setLastIndexTxn(tx, dbSessions, index); err != nil {
 		return err
 	}
-	defer s.watch[s.sessionTable].Notify()
-
-	if err := s.sessionCheckTable.SetLastIndexTxn(tx, index); err != nil {
+	if err := setLastIndexTxn(tx, dbSessionChecks, index); err != nil {
 		return err
 	}
-	defer s.watch[s.sessionCheckTable].Notify()
-
-	return tx.Commit()
+	tx.Commit()
+	s.trackSessionExpiry(session)
+	s.notifyMutations(dbSessions, session.ID)
+	s.watch[dbSessionChecks].Notify()
+	return nil
 }
 
 // SessionRestore is used to restore a session. It should only be used when
 // doing a restore, otherwise SessionCreate should be used.
+//
+// This does not touch s.lockDelay. A restored session is, by
+// definition, one that still exists in the snapshot - lock-delay is
+// only ever recorded by SessionDestroy, at the same moment the
+// session row and its KV Session references are removed. There is no
+// durable trace of an in-flight delay to rebuild from: a session that
+// was destroyed (and so might have a pending delay) is absent from
+// the snapshot entirely, and the KV entries it held are restored with
+// Session already cleared. lockDelay's own comment documents it as
+// ephemeral, single-node, best-effort state for exactly this reason -
+// a newly elected leader starts every key's lock-delay clock at zero
+// rather than trying to reconstruct a deadline that was never
+// replicated.
 func (s *StateStore) SessionRestore(session *structs.Session) error {
-	// Start the transaction
-	tables := MDBTables{s.nodeTable, s.checkTable,
-		s.sessionTable, s.sessionCheckTable}
-	tx, err := tables.StartTxn(false)
-	if err != nil {
-		panic(fmt.Errorf("Failed to start txn: %v", err))
-	}
+	tx := s.db.Txn(true)
 	defer tx.Abort()
 
-	// Insert the session
-	if err := s.sessionTable.InsertTxn(tx, session); err != nil {
-		return err
+	if err := tx.Insert(dbSessions, session); err != nil {
+		return fmt.Errorf("failed inserting session: %v", err)
 	}
 
-	// Insert the check mappings
 	sCheck := sessionCheck{Node: session.Node, Session: session.ID}
 	for _, checkID := range session.Checks {
 		sCheck.CheckID = checkID
-		if err := s.sessionCheckTable.InsertTxn(tx, &sCheck); err != nil {
-			return err
+		entry := sCheck
+		if err := tx.Insert(dbSessionChecks, &entry); err != nil {
+			return fmt.Errorf("failed inserting session check: %v", err)
 		}
 	}
 
-	// Trigger the update notifications
 	index := session.CreateIndex
-	if err := s.sessionTable.SetMaxLastIndexTxn(tx, index); err != nil {
+	if cur := lastIndexTxn(tx, dbSessions); index > cur {
+		if err := setLastIndexTxn(tx, dbSessions, index); err != nil {
+			return err
+		}
+	}
+	if cur := lastIndexTxn(tx, dbSessionChecks); index > cur {
+		if err := setLastIndexTxn(tx, dbSessionChecks, index); err != nil {
+			return err
+		}
+	}
+	tx.Commit()
+	s.trackSessionExpiry(session)
+	s.notifyMutations(dbSessions, session.ID)
+	s.watch[dbSessionChecks].Notify()
+	return nil
+}
+
+// SessionRenew resets a session's TTL clock, pushing its expiration
+// deadline forward by session.TTL. It returns the updated session,
+// or a nil session if it no longer exists (e.g. it already expired).
+func (s *StateStore) SessionRenew(index uint64, sessionID string) (*structs.Session, error) {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	raw, err := tx.First(dbSessions, "id", sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, nil
+	}
+
+	session := new(structs.Session)
+	*session = *raw.(*structs.Session)
+	session.LastRenewal = time.Now()
+
+	if err := tx.Insert(dbSessions, session); err != nil {
+		return nil, fmt.Errorf("failed updating session: %v", err)
+	}
+	if err := setLastIndexTxn(tx, dbSessions, index); err != nil {
+		return nil, err
+	}
+	tx.Commit()
+
+	s.trackSessionExpiry(session)
+	s.notifyMutations(dbSessions, session.ID)
+	return session, nil
+}
+
+// SessionDestroy is used to remove a session and its check mappings
+func (s *StateStore) SessionDestroy(index uint64, sessionID string) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	lockDelay := defaultLockDelay
+	if raw, err := tx.First(dbSessions, "id", sessionID); err != nil {
+		return err
+	} else if raw != nil {
+		if sess := raw.(*structs.Session); sess.LockDelay > 0 {
+			lockDelay = sess.LockDelay
+		}
+		if err := tx.Delete(dbSessions, raw); err != nil {
+			return err
+		}
+	}
+	if _, err := deletePrefixTxn(tx, dbSessionChecks, "session", sessionID); err != nil {
 		return err
 	}
-	defer s.watch[s.sessionTable].Notify()
 
-	if err := s.sessionCheckTable.SetMaxLastIndexTxn(tx, index); err != nil {
+	// Release any KV locks this session held. The lock-delay is
+	// applied below, after commit, so a watcher woken by the release
+	// can't win the re-acquire race before the delay is recorded.
+	releasedKeys, err := s.releaseSessionLocksTxn(tx, index, sessionID)
+	if err != nil {
 		return err
 	}
-	defer s.watch[s.sessionCheckTable].Notify()
+	if len(releasedKeys) > 0 {
+		if err := setLastIndexTxn(tx, dbKVS, index); err != nil {
+			return err
+		}
+	}
 
-	return tx.Commit()
+	if err := setLastIndexTxn(tx, dbSessions, index); err != nil {
+		return err
+	}
+	if err := setLastIndexTxn(tx, dbSessionChecks, index); err != nil {
+		return err
+	}
+	tx.Commit()
+
+	s.untrackSessionExpiry(sessionID)
+	s.notifyMutations(dbSessions, sessionID)
+	s.watch[dbSessionChecks].Notify()
+
+	for _, key := range releasedKeys {
+		s.setLockDelay(key, lockDelay)
+	}
+	if len(releasedKeys) > 0 {
+		s.watch[dbKVS].Notify()
+		for _, key := range releasedKeys {
+			s.keyWatches[dbKVS].Notify(key, false)
+		}
+	}
+	return nil
 }
 
-// Snapshot is used to create a point in time snapshot
-func (s *StateStore) Snapshot() (*StateSnapshot, error) {
-	// Begin a new txn on all tables
-	tx, err := s.tables.StartTxn(true)
-	if err != nil {
-		return nil, err
+// trackSessionExpiry (re)schedules a session's entry in the
+// expiration heap based on session.LastRenewal + session.TTL, and
+// wakes the invalidator so it can recompute its sleep. Sessions
+// without a TTL are never tracked; they only go away via explicit
+// SessionDestroy.
+func (s *StateStore) trackSessionExpiry(session *structs.Session) {
+	ttl, err := time.ParseDuration(session.TTL)
+	if err != nil || ttl <= 0 {
+		return
+	}
+	deadline := session.LastRenewal.Add(ttl)
+
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+	if item, ok := s.sessionExpires[session.ID]; ok {
+		item.deadline = deadline
+		heap.Fix(&s.sessionHeap, item.index)
+	} else {
+		item := &sessionExpiry{session: session.ID, deadline: deadline}
+		heap.Push(&s.sessionHeap, item)
+		s.sessionExpires[session.ID] = item
 	}
+	s.wakeInvalidator()
+}
 
-	// Determine the max index
-	index, err := s.tables.LastIndexTxn(tx)
-	if err != nil {
-		tx.Abort()
-		return nil, err
+// untrackSessionExpiry removes a session from the expiration heap.
+// It is called by SessionDestroy, which is also the path a TTL expiry
+// takes once the expire callback has pushed the destroy through Raft.
+func (s *StateStore) untrackSessionExpiry(sessionID string) {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+	item, ok := s.sessionExpires[sessionID]
+	if !ok {
+		return
+	}
+	heap.Remove(&s.sessionHeap, item.index)
+	delete(s.sessionExpires, sessionID)
+}
+
+// wakeInvalidator pokes the invalidator goroutine. Must be called
+// with sessionLock held. The channel is buffered by one and the send
+// is non-blocking, so bursts of renewals collapse into a single
+// wakeup instead of queuing.
+func (s *StateStore) wakeInvalidator() {
+	select {
+	case s.sessionWakeCh <- struct{}{}:
+	default:
 	}
+}
+
+// StartSessionTTLClock starts the background goroutine that expires
+// sessions whose TTL has elapsed. This must only run on the Raft
+// leader, so the server layer is expected to call this on gaining
+// leadership and StopSessionTTLClock on losing it. Calling it while
+// already running is a no-op.
+//
+// expire is invoked with the ID of each session whose TTL has
+// elapsed; it must submit a SessionDestroy through the Raft log (e.g.
+// raftApply), not call SessionDestroy on this StateStore directly.
+// The invalidator only ever observes local state, so a destroy
+// applied here instead of through Raft would never replicate to
+// followers and could race the FSM's own index sequencing.
+func (s *StateStore) StartSessionTTLClock(expire func(sessionID string)) {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+	if s.sessionStopCh != nil {
+		return
+	}
+	stopCh := make(chan struct{})
+	s.sessionStopCh = stopCh
+	go s.sessionTTLInvalidator(stopCh, expire)
+}
+
+// StopSessionTTLClock halts the invalidator goroutine started by
+// StartSessionTTLClock. Safe to call even if it isn't running.
+func (s *StateStore) StopSessionTTLClock() {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+	if s.sessionStopCh == nil {
+		return
+	}
+	close(s.sessionStopCh)
+	s.sessionStopCh = nil
+}
+
+// sessionTTLInvalidator sleeps until the next session in the
+// expiration heap is due, then hands every session whose deadline has
+// passed to expire. Sleeping on the heap head avoids an O(N) scan of
+// sessionTable on every tick.
+func (s *StateStore) sessionTTLInvalidator(stopCh chan struct{}, expire func(sessionID string)) {
+	for {
+		s.sessionLock.Lock()
+		if s.sessionHeap.Len() == 0 {
+			s.sessionLock.Unlock()
+			select {
+			case <-s.sessionWakeCh:
+				continue
+			case <-stopCh:
+				return
+			}
+		}
+		wait := s.sessionHeap[0].deadline.Sub(time.Now())
+		s.sessionLock.Unlock()
+
+		if wait < 0 {
+			wait = 0
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			s.expireSessions(expire)
+		case <-s.sessionWakeCh:
+			timer.Stop()
+		case <-stopCh:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// expireSessions pops every session in the heap whose deadline has
+// already passed and hands its ID to expire. It does not call
+// SessionDestroy itself: this goroutine only has a local, unreplicated
+// view of session state, so mutating the StateStore directly here
+// would bypass the Raft log entirely. expire is expected to submit
+// the destroy through Raft so every replica applies it at the same
+// index; the heap entry is popped up front so a destroy that's still
+// in flight through Raft isn't re-submitted on the next tick.
+func (s *StateStore) expireSessions(expire func(sessionID string)) {
+	now := time.Now()
+	for {
+		s.sessionLock.Lock()
+		if s.sessionHeap.Len() == 0 || s.sessionHeap[0].deadline.After(now) {
+			s.sessionLock.Unlock()
+			return
+		}
+		item := heap.Pop(&s.sessionHeap).(*sessionExpiry)
+		delete(s.sessionExpires, item.session)
+		s.sessionLock.Unlock()
+
+		expire(item.session)
+	}
+}
+
+// Snapshot is used to create a point in time snapshot. Because the
+// backing tables are persistent radix trees, this is nothing more
+// than starting a read transaction and retaining it; no data is
+// copied and concurrent writers do not block on it.
+func (s *StateStore) Snapshot() (*StateSnapshot, error) {
+	tx := s.db.Txn(false)
+	index := lastIndexTxn(tx, dbNodes, dbServices, dbChecks, dbKVS, dbSessions, dbSessionChecks)
 
-	// Return the snapshot
 	snap := &StateSnapshot{
 		store:     s,
 		tx:        tx,
@@ -1241,37 +1943,43 @@ func (s *StateSnapshot) LastIndex() uint64 {
 	return s.lastIndex
 }
 
-// Nodes returns all the known nodes, the slice alternates between
-// the node name and address
+// Nodes returns all the known nodes
 func (s *StateSnapshot) Nodes() structs.Nodes {
-	res, err := s.store.nodeTable.GetTxn(s.tx, "id")
+	iter, err := s.tx.Get(dbNodes, "id")
 	if err != nil {
 		s.store.logger.Printf("[ERR] consul.state: Failed to get nodes: %v", err)
 		return nil
 	}
-	results := make([]structs.Node, len(res))
-	for i, r := range res {
-		results[i] = *r.(*structs.Node)
+	var results structs.Nodes
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		results = append(results, *raw.(*structs.Node))
 	}
 	return results
 }
 
 // NodeServices is used to return all the services of a given node
 func (s *StateSnapshot) NodeServices(name string) *structs.NodeServices {
-	_, res := s.store.parseNodeServices(s.store.tables, s.tx, name)
+	_, res := s.store.parseNodeServices(s.tx, name)
 	return res
 }
 
 // NodeChecks is used to return all the checks of a given node
 func (s *StateSnapshot) NodeChecks(node string) structs.HealthChecks {
-	res, err := s.store.checkTable.GetTxn(s.tx, "id", node)
-	_, checks := s.store.parseHealthChecks(s.lastIndex, res, err)
-	return checks
+	iter, err := s.tx.Get(dbChecks, "node", node)
+	return s.store.parseHealthChecks(iter, err)
 }
 
 // KVSDump is used to list all KV entries. It takes a channel and streams
-// back *struct.DirEntry objects. This will block and should be invoked
+// back *structs.DirEntry objects. This will block and should be invoked
 // in a goroutine.
 func (s *StateSnapshot) KVSDump(stream chan<- interface{}) error {
-	return s.store.kvsTable.StreamTxn(stream, s.tx, "id")
+	defer close(stream)
+	iter, err := s.tx.Get(dbKVS, "id")
+	if err != nil {
+		return err
+	}
+	for raw := iter.Next(); raw != nil; raw = iter.Next() {
+		stream <- raw.(*structs.DirEntry)
+	}
+	return nil
 }
@@ -0,0 +1,199 @@
+package consul
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/consul/structs"
+)
+
+// testStateStore returns a StateStore ready for use in tests
+func testStateStore(t *testing.T) *StateStore {
+	s, err := NewStateStore(os.Stderr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return s
+}
+
+func TestStateStore_EnsureNode(t *testing.T) {
+	s := testStateStore(t)
+
+	if err := s.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, found, addr := s.GetNode("foo")
+	if !found || addr != "127.0.0.1" {
+		t.Fatalf("bad: %v %v", found, addr)
+	}
+	if idx != 1 {
+		t.Fatalf("bad index: %d", idx)
+	}
+}
+
+func TestStateStore_EnsureService(t *testing.T) {
+	s := testStateStore(t)
+
+	if err := s.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ns := &structs.NodeService{ID: "db1", Service: "db", Tags: []string{"master"}, Port: 8000}
+	if err := s.EnsureService(2, "foo", ns); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, out := s.NodeServices("foo")
+	if idx != 2 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	if _, ok := out.Services["db1"]; !ok {
+		t.Fatalf("missing service: %#v", out)
+	}
+}
+
+func TestStateStore_EnsureCheck(t *testing.T) {
+	s := testStateStore(t)
+
+	if err := s.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	check := &structs.HealthCheck{Node: "foo", CheckID: "chk1", Status: structs.HealthPassing}
+	if err := s.EnsureCheck(2, check); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, checks := s.NodeChecks("foo")
+	if idx != 2 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	if len(checks) != 1 || checks[0].CheckID != "chk1" {
+		t.Fatalf("bad: %#v", checks)
+	}
+}
+
+func TestStateStore_KVSSet(t *testing.T) {
+	s := testStateStore(t)
+
+	if err := s.KVSSet(1, &structs.DirEntry{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	idx, d, err := s.KVSGet("foo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 1 {
+		t.Fatalf("bad index: %d", idx)
+	}
+	if d == nil || string(d.Value) != "bar" {
+		t.Fatalf("bad: %#v", d)
+	}
+}
+
+func TestStateStore_SessionCreate(t *testing.T) {
+	s := testStateStore(t)
+
+	if err := s.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	session := &structs.Session{Node: "foo"}
+	if err := s.SessionCreate(2, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if session.ID == "" {
+		t.Fatalf("missing session ID")
+	}
+}
+
+// TestStateStore_SessionTTLExpire exercises the heap-driven invalidator:
+// a session with a short TTL that is never renewed should be handed to
+// the expire callback once its deadline passes.
+func TestStateStore_SessionTTLExpire(t *testing.T) {
+	s := testStateStore(t)
+
+	if err := s.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	session := &structs.Session{Node: "foo", TTL: "50ms"}
+	if err := s.SessionCreate(2, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expired := make(chan string, 1)
+	s.StartSessionTTLClock(func(sessionID string) {
+		expired <- sessionID
+	})
+	defer s.StopSessionTTLClock()
+
+	select {
+	case id := <-expired:
+		if id != session.ID {
+			t.Fatalf("bad session: %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("session never expired")
+	}
+}
+
+// TestStateStore_KVSLockDelay exercises the lock-delay path: once a
+// session holding a lock is destroyed, the key must be rejected until
+// the delay elapses, and accepted afterwards.
+func TestStateStore_KVSLockDelay(t *testing.T) {
+	s := testStateStore(t)
+
+	if err := s.EnsureNode(1, structs.Node{Node: "foo", Address: "127.0.0.1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	session := &structs.Session{Node: "foo", LockDelay: 20 * time.Millisecond}
+	if err := s.SessionCreate(2, session); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ok, err := s.KVSLock(3, &structs.DirEntry{Key: "foo", Session: session.ID})
+	if err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+
+	if err := s.SessionDestroy(4, session.ID); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ok, err = s.KVSLock(5, &structs.DirEntry{Key: "foo", Session: session.ID})
+	if err != nil || ok {
+		t.Fatalf("lock should be delayed: %v %v", ok, err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	ok, err = s.KVSLock(6, &structs.DirEntry{Key: "foo", Session: session.ID})
+	if err != nil || !ok {
+		t.Fatalf("lock should succeed after delay: %v %v", ok, err)
+	}
+}
+
+// TestPrefixWatch_Release ensures a key/prefix's radix node is pruned
+// once every GetSubwatch reference on it has been released, so a
+// long-running watcher of many distinct keys doesn't leak nodes.
+func TestPrefixWatch_Release(t *testing.T) {
+	p := NewPrefixWatch()
+
+	p.GetSubwatch("foo")
+	p.GetSubwatch("foo")
+	if p.tree.Len() != 1 {
+		t.Fatalf("bad: %d", p.tree.Len())
+	}
+
+	p.Release("foo")
+	if p.tree.Len() != 1 {
+		t.Fatalf("node pruned too early: %d", p.tree.Len())
+	}
+
+	p.Release("foo")
+	if p.tree.Len() != 0 {
+		t.Fatalf("node not pruned: %d", p.tree.Len())
+	}
+}